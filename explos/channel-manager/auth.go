@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertybot"
+
+	"github.com/pmg-tools/berty-bot-experiments/pkg/authsign"
+	"github.com/pmg-tools/berty-bot-experiments/pkg/backoff"
+)
+
+// teritoriNonceResponse is the payload returned by GET {apiAdr}/nonce.
+type teritoriNonceResponse struct {
+	Nonce string `json:"nonce"`
+}
+
+// teritoriAuthRequest is POSTed to {apiAdr}/auth once the challenge has
+// been signed.
+type teritoriAuthRequest struct {
+	Pubkey    string `json:"pubkey"`
+	Signature string `json:"signature"`
+	Nonce     string `json:"nonce"`
+	Sender    string `json:"sender"`
+}
+
+// teritoriAuthResponse is the bearer token handed back on success.
+type teritoriAuthResponse struct {
+	Token     string    `json:"token"`
+	Account   string    `json:"account"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// TeritoriAuth signs a Teritori API challenge with the bot's loaded keypair
+// and stores the resulting bearer token against the calling conversation,
+// so later commands (refresh, add-channel, ...) can act as that account.
+func TeritoriAuth(dbA *SqliteDB) bertybot.CommandFunc {
+	return func(ctx bertybot.Context) {
+		if ctx.IsReplay || !ctx.IsNew {
+			return
+		}
+
+		conversationID := ctx.Interaction.ConversationPublicKey
+		alg, err := authsign.ParseAlg(opts.sigAlg)
+		if err != nil {
+			_ = ctx.ReplyString(fmt.Sprintf("auth failed: %v", err))
+			return
+		}
+
+		nonce, err := fetchTeritoriNonce(context.Background(), opts.apiAdr)
+		if err != nil {
+			_ = ctx.ReplyString(fmt.Sprintf("auth failed: could not fetch nonce: %v", err))
+			return
+		}
+
+		// bertyPublicKey here is the bot's KeyStore signing identity (the
+		// store's active key, read on every call so that rotate-keys takes
+		// effect immediately), not the ephemeral Berty account key bot.PublicKey()
+		// exposes: TeritoriAuth only has DB/key-store access, and the
+		// KeyStore identity is what the API verifies signatures against.
+		//
+		// Raw key bytes are rarely valid UTF-8, so they can't be carried
+		// as-is through a JSON string field (json.Marshal would replace
+		// invalid bytes with U+FFFD, corrupting the key). Hex-encode the
+		// pubkey the same way the signature already is, and sign that
+		// same hex string so what the server verifies against is exactly
+		// what was signed.
+		key, err := NewSqliteKeyStore(dbA).Current()
+		if err != nil {
+			_ = ctx.ReplyString(fmt.Sprintf("auth failed: %v", err))
+			return
+		}
+		publicKeyHex := fmt.Sprintf("%x", authsign.DecodeKeyBytes(key.PublicPEM))
+		challenge := authsign.BuildChallenge(nonce, publicKeyHex, conversationID)
+		signature, err := authsign.Sign(alg, authsign.DecodeKeyBytes(key.PrivatePEM), challenge)
+		if err != nil {
+			_ = ctx.ReplyString(fmt.Sprintf("auth failed: signing error: %v", err))
+			return
+		}
+
+		resp, err := postTeritoriAuth(context.Background(), opts.apiAdr, teritoriAuthRequest{
+			Pubkey:    publicKeyHex,
+			Signature: fmt.Sprintf("%x", signature),
+			Nonce:     nonce,
+			Sender:    conversationID,
+		})
+		if err != nil {
+			_ = ctx.ReplyString(fmt.Sprintf("auth failed: %v", err))
+			return
+		}
+
+		if err := dbA.SaveTeritoriToken(conversationID, resp.Account, resp.Token, resp.ExpiresAt); err != nil {
+			_ = ctx.ReplyString(fmt.Sprintf("auth failed: could not persist token: %v", err))
+			return
+		}
+
+		_ = ctx.ReplyString(fmt.Sprintf("linked to Teritori account %s (token expires %s)", resp.Account, resp.ExpiresAt.Format(time.RFC3339)))
+	}
+}
+
+// Whoami reports the Teritori account currently linked to the calling
+// conversation, and when its bearer token expires.
+func Whoami(dbA *SqliteDB) bertybot.CommandFunc {
+	return func(ctx bertybot.Context) {
+		if ctx.IsReplay || !ctx.IsNew {
+			return
+		}
+
+		conversationID := ctx.Interaction.ConversationPublicKey
+		account, _, expiresAt, err := dbA.GetTeritoriToken(conversationID)
+		if err != nil {
+			_ = ctx.ReplyString("no Teritori account linked, run link-teritori-account first")
+			return
+		}
+
+		_ = ctx.ReplyString(fmt.Sprintf("linked account: %s (token expires %s)", account, expiresAt.Format(time.RFC3339)))
+	}
+}
+
+func fetchTeritoriNonce(ctx context.Context, apiAdr string) (string, error) {
+	var out teritoriNonceResponse
+	err := backoff.Do(ctx, opts.retry, opts.rootLogger.Named("auth"), "fetch teritori nonce", func() error {
+		resp, err := http.Get(apiAdr + "/nonce")
+		if err != nil {
+			return fmt.Errorf("request nonce: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(resp.Body)
+			err := fmt.Errorf("nonce request: status %d: %s", resp.StatusCode, body)
+			if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+				return backoff.Permanent(err)
+			}
+			return err
+		}
+
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			return backoff.Permanent(fmt.Errorf("decode nonce response: %w", err))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return out.Nonce, nil
+}
+
+func postTeritoriAuth(ctx context.Context, apiAdr string, req teritoriAuthRequest) (*teritoriAuthResponse, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("encode auth request: %w", err)
+	}
+
+	var out teritoriAuthResponse
+	err = backoff.Do(ctx, opts.retry, opts.rootLogger.Named("auth"), "post teritori auth", func() error {
+		resp, err := http.Post(apiAdr+"/auth", "application/json", bytes.NewReader(payload))
+		if err != nil {
+			return fmt.Errorf("auth request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(resp.Body)
+			err := fmt.Errorf("auth request: status %d: %s", resp.StatusCode, body)
+			if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+				return backoff.Permanent(err)
+			}
+			return err
+		}
+
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			return backoff.Permanent(fmt.Errorf("decode auth response: %w", err))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import "fmt"
+
+// CountWorkspaces returns the number of workspaces currently tracked in
+// the DB, for the bot_active_workspaces gauge.
+func (db *SqliteDB) CountWorkspaces() (int, error) {
+	var n int
+	if err := db.conn.QueryRow(`SELECT COUNT(*) FROM workspaces`).Scan(&n); err != nil {
+		return 0, fmt.Errorf("count workspaces: %w", err)
+	}
+	return n, nil
+}
+
+// CountChannels returns the number of channels currently tracked in the
+// DB, for the bot_active_channels gauge.
+func (db *SqliteDB) CountChannels() (int, error) {
+	var n int
+	if err := db.conn.QueryRow(`SELECT COUNT(*) FROM channels`).Scan(&n); err != nil {
+		return 0, fmt.Errorf("count channels: %w", err)
+	}
+	return n, nil
+}
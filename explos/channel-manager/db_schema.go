@@ -0,0 +1,39 @@
+package main
+
+import "fmt"
+
+// keysTableSchema backs the KeyStore: one row per keypair the bot has ever
+// held, with at most one active at a time (enforced by KeyStore.Rotate,
+// not by the schema).
+const keysTableSchema = `
+CREATE TABLE IF NOT EXISTS keys (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	algo        TEXT NOT NULL,
+	private_pem BLOB NOT NULL,
+	public_pem  BLOB NOT NULL,
+	active      INTEGER NOT NULL DEFAULT 0,
+	created_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`
+
+// teritoriTokensTableSchema backs SaveTeritoriToken/GetTeritoriToken: one
+// row per conversation that has linked a Teritori account.
+const teritoriTokensTableSchema = `
+CREATE TABLE IF NOT EXISTS teritori_tokens (
+	conversation_id TEXT PRIMARY KEY,
+	account         TEXT NOT NULL,
+	token           TEXT NOT NULL,
+	expires_at      TIMESTAMP NOT NULL
+)`
+
+// ensureSchema creates any table this package's own code depends on that
+// isn't already part of the bot's base schema. It is idempotent and safe
+// to call on every startup.
+func ensureSchema(db *SqliteDB) error {
+	if _, err := db.conn.Exec(keysTableSchema); err != nil {
+		return fmt.Errorf("create keys table: %w", err)
+	}
+	if _, err := db.conn.Exec(teritoriTokensTableSchema); err != nil {
+		return fmt.Errorf("create teritori_tokens table: %w", err)
+	}
+	return nil
+}
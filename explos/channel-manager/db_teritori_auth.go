@@ -0,0 +1,40 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// SaveTeritoriToken upserts the bearer token obtained for conversationID so
+// that later commands (refresh, add-channel, ...) can act on behalf of the
+// linked Teritori account.
+func (db *SqliteDB) SaveTeritoriToken(conversationID, account, token string, expiresAt time.Time) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO teritori_tokens (conversation_id, account, token, expires_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(conversation_id) DO UPDATE SET
+			account = excluded.account,
+			token = excluded.token,
+			expires_at = excluded.expires_at
+	`, conversationID, account, token, expiresAt)
+	if err != nil {
+		return fmt.Errorf("save teritori token: %w", err)
+	}
+	return nil
+}
+
+// GetTeritoriToken returns the Teritori account, bearer token and expiry
+// linked to conversationID, or an error if none has been linked yet.
+func (db *SqliteDB) GetTeritoriToken(conversationID string) (account, token string, expiresAt time.Time, err error) {
+	row := db.conn.QueryRow(`
+		SELECT account, token, expires_at FROM teritori_tokens WHERE conversation_id = ?
+	`, conversationID)
+	if err := row.Scan(&account, &token, &expiresAt); err != nil {
+		if err == sql.ErrNoRows {
+			return "", "", time.Time{}, fmt.Errorf("no Teritori token linked for this conversation")
+		}
+		return "", "", time.Time{}, fmt.Errorf("get teritori token: %w", err)
+	}
+	return account, token, expiresAt, nil
+}
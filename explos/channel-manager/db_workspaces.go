@@ -0,0 +1,34 @@
+package main
+
+import "fmt"
+
+// IsWorkspaceOwner reports whether conversationID is the owner of the
+// named workspace, for the requireWorkspaceOwner middleware.
+func (db *SqliteDB) IsWorkspaceOwner(conversationID, workspace string) (bool, error) {
+	var owner string
+	err := db.conn.QueryRow(`SELECT owner_conversation_id FROM workspaces WHERE name = ?`, workspace).Scan(&owner)
+	if err != nil {
+		return false, fmt.Errorf("lookup workspace owner: %w", err)
+	}
+	return owner == conversationID, nil
+}
+
+// ListWorkspaceNames returns every workspace name currently tracked, for
+// bertyBotRefreshAll to iterate over.
+func (db *SqliteDB) ListWorkspaceNames() ([]string, error) {
+	rows, err := db.conn.Query(`SELECT name FROM workspaces`)
+	if err != nil {
+		return nil, fmt.Errorf("list workspaces: %w", err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("scan workspace name: %w", err)
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"berty.tech/berty/v2/go/pkg/initutil"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// bufconnBufSize is the size of the in-memory socket used to reach the
+// embedded node; it never touches the network, so it only needs to be big
+// enough to avoid backpressure on large messenger events.
+const bufconnBufSize = 1024 * 1024
+
+// newInmemMessengerClient boots an in-process account manager the same way
+// `berty daemon` does internally (protocol + messenger services wired
+// together through a local grpc.Server), and returns a MessengerServiceClient
+// dialed against it over a bufconn listener instead of a real socket.
+//
+// When storeDir is empty, the account's repo lives in a temporary directory
+// that is wiped when the process exits; otherwise the account persists
+// across restarts, same as a regular daemon-backed bot.
+func newInmemMessengerClient(ctx context.Context, logger *zap.Logger, storeDir string) (messengertypes.MessengerServiceClient, error) {
+	ephemeral := storeDir == ""
+	if ephemeral {
+		tmpDir, err := ioutil.TempDir("", "channel-manager-inmem-")
+		if err != nil {
+			return nil, fmt.Errorf("create temp store: %w", err)
+		}
+		storeDir = tmpDir
+	} else if err := os.MkdirAll(storeDir, 0o700); err != nil {
+		return nil, fmt.Errorf("create store dir: %w", err)
+	}
+
+	manager := initutil.New(nil)
+	manager.SetArgs([]string{
+		"--store.dir=" + storeDir,
+		"--node.listeners=",
+	})
+	manager.SetLogger(logger)
+
+	if _, err := manager.GetLocalMessengerServer(); err != nil {
+		_ = manager.Close(nil)
+		return nil, fmt.Errorf("start local messenger server: %w", err)
+	}
+
+	server := grpc.NewServer()
+	messengerServer, err := manager.GetMessengerServer()
+	if err != nil {
+		_ = manager.Close(nil)
+		return nil, fmt.Errorf("get messenger server: %w", err)
+	}
+	messengertypes.RegisterMessengerServiceServer(server, messengerServer)
+
+	listener := bufconn.Listen(bufconnBufSize)
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logger.Debug("inmem grpc server stopped", zap.Error(err))
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+		_ = manager.Close(nil)
+		if ephemeral {
+			_ = os.RemoveAll(storeDir)
+		}
+	}()
+
+	cc, err := grpc.DialContext(ctx, "bufconn",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithInsecure(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("dial inmem node: %w", err)
+	}
+
+	logger.Info("embedded Berty node ready", zap.String("store-dir", storeDir))
+
+	return messengertypes.NewMessengerServiceClient(cc), nil
+}
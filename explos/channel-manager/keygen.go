@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec"
+
+	"github.com/pmg-tools/berty-bot-experiments/pkg/authsign"
+)
+
+// generateKeyPEM creates a fresh keypair for algo and PEM-encodes both
+// halves for storage in the keys table.
+//
+// The PEM blocks hold this project's own raw-key-bytes convention (see
+// authsign.DecodeKeyBytes), not standard PKCS#8/SEC1 DER, so the block
+// type is deliberately not "PRIVATE KEY"/"PUBLIC KEY" — that would imply
+// the contents are parseable by generic PEM/PKCS#8 tooling, which they are
+// not.
+func generateKeyPEM(algo authsign.Alg) (privatePEM, publicPEM []byte, err error) {
+	switch algo {
+	case authsign.AlgEd25519:
+		pub, priv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("generate ed25519 key: %w", err)
+		}
+		return encodePEM("BERTY BOT RAW PRIVATE KEY", priv), encodePEM("BERTY BOT RAW PUBLIC KEY", pub), nil
+
+	case authsign.AlgSecp256k1:
+		priv, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			return nil, nil, fmt.Errorf("generate secp256k1 key: %w", err)
+		}
+		return encodePEM("BERTY BOT RAW PRIVATE KEY", priv.Serialize()), encodePEM("BERTY BOT RAW PUBLIC KEY", priv.PubKey().SerializeCompressed()), nil
+
+	default:
+		return nil, nil, fmt.Errorf("unsupported signature algorithm %q", algo)
+	}
+}
+
+func encodePEM(kind string, raw []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: raw})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+
+	"berty.tech/berty/v2/go/pkg/bertybot"
+
+	"github.com/pmg-tools/berty-bot-experiments/pkg/authsign"
+)
+
+// RotateKeys creates a new active key in store, keeping the previous one
+// around (inactive) so signatures made with it still verify.
+func RotateKeys(store KeyStore) bertybot.CommandFunc {
+	return func(ctx bertybot.Context) {
+		if ctx.IsReplay || !ctx.IsNew {
+			return
+		}
+
+		alg, err := authsign.ParseAlg(opts.sigAlg)
+		if err != nil {
+			_ = ctx.ReplyString(fmt.Sprintf("rotate-keys failed: %v", err))
+			return
+		}
+
+		key, err := store.Rotate(alg)
+		if err != nil {
+			_ = ctx.ReplyString(fmt.Sprintf("rotate-keys failed: %v", err))
+			return
+		}
+
+		_ = ctx.ReplyString(fmt.Sprintf("rotated to a new %s key:\n%s", key.Algo, key.PublicPEM))
+	}
+}
+
+// ExportPubkey prints the current public key so it can be registered with
+// Teritori out of band.
+func ExportPubkey(store KeyStore) bertybot.CommandFunc {
+	return func(ctx bertybot.Context) {
+		if ctx.IsReplay || !ctx.IsNew {
+			return
+		}
+
+		pub, err := store.Public()
+		if err != nil {
+			_ = ctx.ReplyString(fmt.Sprintf("export-pubkey failed: %v", err))
+			return
+		}
+
+		_ = ctx.ReplyString(string(pub))
+	}
+}
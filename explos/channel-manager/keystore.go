@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/pmg-tools/berty-bot-experiments/pkg/authsign"
+)
+
+// Key is a single keypair tracked by a KeyStore, active or retired.
+type Key struct {
+	ID         int64
+	Algo       authsign.Alg
+	PrivatePEM []byte
+	PublicPEM  []byte
+	Active     bool
+}
+
+// KeyStore persists the bot's signing identity and lets it be rotated
+// without losing the ability to verify signatures made with past keys.
+type KeyStore interface {
+	// Load imports an externally generated keypair as the active key, used
+	// once on first run when --privatekeyPath/--publickeyPath are set.
+	Load(algo authsign.Alg, privatePEM, publicPEM []byte) error
+	// Save persists key as-is, e.g. after changing its Active flag.
+	Save(key Key) error
+	// Rotate generates a fresh keypair, marks it active, and demotes the
+	// previous active key (kept around to verify past signatures).
+	Rotate(algo authsign.Alg) (Key, error)
+	// Current returns the active key, or an error if the store is empty.
+	Current() (Key, error)
+	// Public returns the active key's public key bytes.
+	Public() ([]byte, error)
+}
+
+// sqliteKeyStore is the KeyStore backed by the bot's existing sqlite DB.
+type sqliteKeyStore struct {
+	db *SqliteDB
+}
+
+// NewSqliteKeyStore returns a KeyStore backed by db's `keys` table.
+func NewSqliteKeyStore(db *SqliteDB) KeyStore {
+	return &sqliteKeyStore{db: db}
+}
+
+func (s *sqliteKeyStore) Load(algo authsign.Alg, privatePEM, publicPEM []byte) error {
+	existing, err := s.Current()
+	if err == nil {
+		_ = existing // a key is already active, nothing to import
+		return nil
+	}
+
+	_, err = s.db.conn.Exec(`
+		INSERT INTO keys (algo, private_pem, public_pem, active, created_at)
+		VALUES (?, ?, ?, 1, CURRENT_TIMESTAMP)
+	`, string(algo), privatePEM, publicPEM)
+	if err != nil {
+		return fmt.Errorf("import key: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteKeyStore) Save(key Key) error {
+	_, err := s.db.conn.Exec(`
+		UPDATE keys SET algo = ?, private_pem = ?, public_pem = ?, active = ? WHERE id = ?
+	`, string(key.Algo), key.PrivatePEM, key.PublicPEM, key.Active, key.ID)
+	if err != nil {
+		return fmt.Errorf("save key: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteKeyStore) Rotate(algo authsign.Alg) (Key, error) {
+	privatePEM, publicPEM, err := generateKeyPEM(algo)
+	if err != nil {
+		return Key{}, fmt.Errorf("generate key: %w", err)
+	}
+
+	tx, err := s.db.conn.Begin()
+	if err != nil {
+		return Key{}, fmt.Errorf("begin rotate: %w", err)
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	if _, err := tx.Exec(`UPDATE keys SET active = 0 WHERE active = 1`); err != nil {
+		return Key{}, fmt.Errorf("demote active key: %w", err)
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO keys (algo, private_pem, public_pem, active, created_at)
+		VALUES (?, ?, ?, 1, CURRENT_TIMESTAMP)
+	`, string(algo), privatePEM, publicPEM)
+	if err != nil {
+		return Key{}, fmt.Errorf("insert rotated key: %w", err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Key{}, fmt.Errorf("rotated key id: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Key{}, fmt.Errorf("commit rotate: %w", err)
+	}
+
+	return Key{ID: id, Algo: algo, PrivatePEM: privatePEM, PublicPEM: publicPEM, Active: true}, nil
+}
+
+func (s *sqliteKeyStore) Current() (Key, error) {
+	var key Key
+	var algo string
+	row := s.db.conn.QueryRow(`
+		SELECT id, algo, private_pem, public_pem, active FROM keys WHERE active = 1
+	`)
+	if err := row.Scan(&key.ID, &algo, &key.PrivatePEM, &key.PublicPEM, &key.Active); err != nil {
+		if err == sql.ErrNoRows {
+			return Key{}, fmt.Errorf("no active key in store")
+		}
+		return Key{}, fmt.Errorf("load active key: %w", err)
+	}
+	key.Algo = authsign.Alg(algo)
+	return key, nil
+}
+
+func (s *sqliteKeyStore) Public() ([]byte, error) {
+	key, err := s.Current()
+	if err != nil {
+		return nil, err
+	}
+	return key.PublicPEM, nil
+}
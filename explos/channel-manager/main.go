@@ -11,11 +11,15 @@ import (
 	"runtime"
 	"sync"
 	"syscall"
+	"time"
 
 	"berty.tech/berty/v2/go/pkg/bertybot"
 	"berty.tech/berty/v2/go/pkg/bertyversion"
 	"berty.tech/berty/v2/go/pkg/messengertypes"
 
+	"github.com/pmg-tools/berty-bot-experiments/pkg/authsign"
+	"github.com/pmg-tools/berty-bot-experiments/pkg/backoff"
+
 	qrterminal "github.com/mdp/qrterminal/v3"
 	"github.com/oklog/run"
 	"github.com/peterbourgon/ff/v3"
@@ -41,11 +45,15 @@ var (
 	opts struct { // nolint:maligned
 		Debug          bool
 		BertyNodeAddr  string
+		Inmem          bool
+		InmemStore     string
 		apiAdr         string
 		rootLogger     *zap.Logger
 		privatekeyPath string
 		publickeyPath  string
-		generateKeys   bool
+		sigAlg         string
+		MetricsListen  string
+		retry          backoff.Config
 	}
 
 	PrivateKey []byte
@@ -62,11 +70,19 @@ func mainRun(args []string) error {
 		FlagSetBuilder: func(fs *flag.FlagSet) {
 			// opts.BertyNodeAddr = ""
 			fs.BoolVar(&opts.Debug, "debug", false, "debug mode")
-			fs.StringVar(&opts.BertyNodeAddr, "berty-node-addr", "127.0.0.1:9091", "Berty node address")
+			fs.StringVar(&opts.BertyNodeAddr, "berty-node-addr", "127.0.0.1:9091", "Berty node address, leave empty to boot an embedded node")
+			fs.BoolVar(&opts.Inmem, "inmem", false, "boot an embedded in-process Berty node instead of dialing --berty-node-addr")
+			fs.StringVar(&opts.InmemStore, "inmem-store", "", "repo directory for the embedded node's account store (empty: ephemeral temp dir, wiped on exit)")
 			fs.StringVar(&opts.apiAdr, "api-adr", "http://127.0.0.1:8080/access", "teritori API address")
 			fs.StringVar(&opts.publickeyPath, "publickeyPath", "", "public key")
 			fs.StringVar(&opts.privatekeyPath, "privatekeyPath", "", "private key")
-			fs.BoolVar(&opts.generateKeys, "generate-keys", false, "generate keys")
+			fs.StringVar(&opts.sigAlg, "sig-alg", "ed25519", "signature algorithm used to authenticate with the Teritori API (ed25519, secp256k1)")
+			fs.StringVar(&opts.MetricsListen, "metrics-listen", "", "listen address for the Prometheus /metrics endpoint (empty: disabled)")
+			fs.DurationVar(&opts.retry.MaxElapsedTime, "retry-max-elapsed", backoff.DefaultConfig.MaxElapsedTime, "give up retrying an outbound call after this long (0: retry forever)")
+			fs.DurationVar(&opts.retry.InitialInterval, "retry-initial-interval", backoff.DefaultConfig.InitialInterval, "delay before the first retry of an outbound call")
+			fs.DurationVar(&opts.retry.MaxInterval, "retry-max-interval", backoff.DefaultConfig.MaxInterval, "cap on the delay between retries of an outbound call")
+			fs.Float64Var(&opts.retry.Multiplier, "retry-multiplier", backoff.DefaultConfig.Multiplier, "multiplier applied to the retry delay after each attempt")
+			fs.Float64Var(&opts.retry.RandomizationFactor, "retry-jitter", backoff.DefaultConfig.RandomizationFactor, "randomization factor (0-1) applied to each retry delay")
 		},
 		Exec:      doRoot,
 		FFOptions: []ff.Option{ff.WithEnvVarPrefix(name)},
@@ -114,8 +130,7 @@ func doRoot(ctx context.Context, args []string) error { // nolint:gocognit
 	}
 
 	if opts.BertyNodeAddr == "" {
-		// FIXME: implement inmem bot.
-		return fmt.Errorf("missing --berty-node-addr: %w", flag.ErrHelp)
+		opts.Inmem = true
 	}
 
 	fmt.Print(motd.Default())
@@ -132,6 +147,15 @@ func doRoot(ctx context.Context, args []string) error { // nolint:gocognit
 	// signal handling
 	g.Add(run.SignalHandler(ctx, syscall.SIGTERM, syscall.SIGINT, os.Interrupt, os.Kill))
 
+	// metrics
+	metricsRegistry = setupMetrics(opts.MetricsListen)
+	if metricsRegistry != nil {
+		g.Add(func() error {
+			logger.Info("Starting metrics server...", zap.String("listen", opts.MetricsListen))
+			return serveMetrics(ctx, opts.MetricsListen, metricsRegistry)
+		}, func(error) {})
+	}
+
 	// berty bot
 	g.Add(func() error {
 		// var dbA = &mockDb{}
@@ -139,30 +163,63 @@ func doRoot(ctx context.Context, args []string) error { // nolint:gocognit
 		if err != nil {
 			return fmt.Errorf("db init: %w", err)
 		}
-
-		// key err handling
-		if opts.generateKeys {
-			err = GenKeys("private.key", "public.key")
-			if err != nil {
-				return err
-			}
-			opts.privatekeyPath = "private.key"
-			opts.publickeyPath = "public.key"
+		if err := ensureSchema(dbA); err != nil {
+			return fmt.Errorf("db schema init: %w", err)
 		}
 
-		if opts.privatekeyPath == "" || opts.publickeyPath == "" {
-			return fmt.Errorf("missing --privatekeyPath or --publickeyPath: %w", flag.ErrHelp)
+		if metricsRegistry != nil {
+			refreshActiveGauges(dbA)
+			go func() {
+				ticker := time.NewTicker(30 * time.Second)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+						refreshActiveGauges(dbA)
+					}
+				}
+			}()
 		}
 
-		PrivateKey, err = ioutil.ReadFile(opts.privatekeyPath)
-		if err != nil {
-			return fmt.Errorf("read private key: %w", err)
+		// keys: the store owns the bot's identity from here on. If a
+		// --privatekeyPath/--publickeyPath pair is given, it is imported
+		// into the store on first run only, then ignored on every
+		// subsequent start.
+		keyStore := NewSqliteKeyStore(dbA)
+
+		if _, curErr := keyStore.Current(); curErr != nil && opts.privatekeyPath != "" && opts.publickeyPath != "" {
+			privatePEM, err := ioutil.ReadFile(opts.privatekeyPath)
+			if err != nil {
+				return fmt.Errorf("read private key: %w", err)
+			}
+			publicPEM, err := ioutil.ReadFile(opts.publickeyPath)
+			if err != nil {
+				return fmt.Errorf("read public key: %w", err)
+			}
+			alg, err := authsign.ParseAlg(opts.sigAlg)
+			if err != nil {
+				return err
+			}
+			if err := keyStore.Load(alg, privatePEM, publicPEM); err != nil {
+				return fmt.Errorf("import key into store: %w", err)
+			}
 		}
 
-		PublicKey, err = ioutil.ReadFile(opts.publickeyPath)
+		key, err := keyStore.Current()
 		if err != nil {
-			return fmt.Errorf("read public key: %w", err)
+			alg, err := authsign.ParseAlg(opts.sigAlg)
+			if err != nil {
+				return err
+			}
+			key, err = keyStore.Rotate(alg)
+			if err != nil {
+				return fmt.Errorf("generate initial key: %w", err)
+			}
 		}
+		PrivateKey = key.PrivatePEM
+		PublicKey = key.PublicPEM
 		//
 
 		mutex := &sync.Mutex{}
@@ -171,11 +228,32 @@ func doRoot(ctx context.Context, args []string) error { // nolint:gocognit
 			_ = ctx.ReplyString("version: " + bertyversion.Version)
 		}
 
-		cc, err := grpc.Dial(opts.BertyNodeAddr, grpc.WithInsecure())
-		if err != nil {
-			return fmt.Errorf("dial error: %w", err)
+		var client messengertypes.MessengerServiceClient
+		if opts.Inmem {
+			client, err = newInmemMessengerClient(ctx, logger.Named("inmem"), opts.InmemStore)
+			if err != nil {
+				return fmt.Errorf("inmem node init: %w", err)
+			}
+		} else {
+			var cc *grpc.ClientConn
+			dialErr := backoff.Do(ctx, opts.retry, logger, "dial berty node", func() error {
+				var err error
+				cc, err = grpc.DialContext(ctx, opts.BertyNodeAddr, grpc.WithInsecure(), grpc.WithBlock())
+				return err
+			})
+			if dialErr != nil {
+				return fmt.Errorf("dial error: %w", dialErr)
+			}
+			client = messengertypes.NewMessengerServiceClient(cc)
 		}
-		client := messengertypes.NewMessengerServiceClient(cc)
+
+		// middleware chains: plain commands only get tracing + rate limiting,
+		// commands touching a Teritori account also require one to be
+		// linked, and commands touching a specific workspace also require
+		// the caller to own it.
+		baseChain := Chain(withTracing(logger), rateLimit(30, time.Minute))
+		authedChain := Chain(withTracing(logger), rateLimit(30, time.Minute), requireLinkedTeritoriAccount(dbA))
+		ownerChain := Chain(withTracing(logger), rateLimit(30, time.Minute), requireLinkedTeritoriAccount(dbA), requireWorkspaceOwner(dbA))
 
 		botName := os.Args[0]
 		newOpts := []bertybot.NewOption{}
@@ -183,28 +261,31 @@ func doRoot(ctx context.Context, args []string) error { // nolint:gocognit
 			bertybot.WithLogger(logger.Named("berty")), // configure a logger
 			bertybot.WithDisplayName(botName),          // bot name
 			// bertybot.WithHandler(bertybot.UserMessageHandler, userMessageHandler), // message handler
-			bertybot.WithCommand("version", "show version", versionCommand),
+			bertybot.WithCommand("version", "show version", instrumentCommand("version", baseChain(versionCommand))),
 			bertybot.WithRecipe(bertybot.AutoAcceptIncomingContactRequestRecipe()),
 			bertybot.WithRecipe(bertybot.AutoAcceptIncomingGroupInviteRecipe()),
 			bertybot.WithRecipe(bertybot.WelcomeMessageRecipe("Hello dear peroquet !")),
-			bertybot.WithCommand("ping", "ping", func(ctx bertybot.Context) {
+			bertybot.WithCommand("ping", "ping", instrumentCommand("ping", baseChain(func(ctx bertybot.Context) {
 				if ctx.IsReplay || !ctx.IsNew {
 					return
 				}
 				_ = ctx.ReplyString("pong")
-			}),
+			}))),
 
 			// CHAN COMMANDS
-			bertybot.WithCommand("add-work", "create a channel", bertyBotAddWorkspace(dbA, mutex)),
-			bertybot.WithCommand("add-channel", "add a channel", bertyBotAddChannel(dbA, mutex)),
-			bertybot.WithCommand("list-workspaces", "list workspaces", bertyBotListWorkspaces(dbA)),
-			bertybot.WithCommand("list-channels", "list channels", bertyBotListChannels(dbA)),
-			bertybot.WithCommand("refresh-all", "refresh channels", bertyBotRefreshAll(dbA, opts.apiAdr)),
-			bertybot.WithCommand("refresh", "refresh", bertyBotRefresh(dbA, opts.apiAdr)),
+			bertybot.WithCommand("add-work", "create a channel", instrumentCommand("add-work", authedChain(bertyBotAddWorkspace(dbA, mutex)))),
+			bertybot.WithCommand("add-channel", "add a channel", instrumentCommand("add-channel", ownerChain(bertyBotAddChannel(dbA, mutex)))),
+			bertybot.WithCommand("list-workspaces", "list workspaces", instrumentCommand("list-workspaces", authedChain(bertyBotListWorkspaces(dbA)))),
+			bertybot.WithCommand("list-channels", "list channels", instrumentCommand("list-channels", authedChain(bertyBotListChannels(dbA)))),
+			bertybot.WithCommand("refresh-all", "refresh channels", instrumentCommand("refresh-all", authedChain(bertyBotRefreshAll(dbA, opts.apiAdr)))),
+			bertybot.WithCommand("refresh", "refresh", instrumentCommand("refresh", ownerChain(bertyBotRefresh(dbA, opts.apiAdr)))),
 			//
 
 			// AUTH COMMANDS
-			bertybot.WithCommand("link-teritori-account", "auth", TeritoriAuth(dbA)),
+			bertybot.WithCommand("link-teritori-account", "auth", instrumentCommand("link-teritori-account", baseChain(TeritoriAuth(dbA)))),
+			bertybot.WithCommand("whoami", "show the linked Teritori account", instrumentCommand("whoami", baseChain(Whoami(dbA)))),
+			bertybot.WithCommand("rotate-keys", "rotate the bot's signing key", instrumentCommand("rotate-keys", baseChain(RotateKeys(keyStore)))),
+			bertybot.WithCommand("export-pubkey", "print the bot's current public key", instrumentCommand("export-pubkey", baseChain(ExportPubkey(keyStore)))),
 			//
 
 			bertybot.WithMessengerClient(client),
@@ -225,7 +306,20 @@ func doRoot(ctx context.Context, args []string) error { // nolint:gocognit
 			qrterminal.GenerateHalfBlock(bot.BertyIDURL(), qrterminal.L, os.Stdout)
 		}
 
-		return bot.Start(ctx)
+		// the messenger event stream drops on daemon restarts; retry it with
+		// the same backoff curve used for the initial dial, but with
+		// MaxElapsedTime forced to 0 (retry forever). --retry-max-elapsed
+		// bounds a single bounded operation (a dial, an HTTP call); here
+		// backoff.Do wraps bot.Start for the lifetime of the process, so its
+		// elapsed clock starts once at bot startup, not per disconnect. Using
+		// opts.retry as-is would mean the first stream drop after the bot had
+		// been up longer than --retry-max-elapsed kills it instead of
+		// reconnecting, which is the opposite of surviving daemon restarts.
+		streamRetry := opts.retry
+		streamRetry.MaxElapsedTime = 0
+		return backoff.Do(ctx, streamRetry, logger, "messenger event stream", func() error {
+			return bot.Start(ctx)
+		})
 	}, func(error) {})
 
 	logger.Info("Starting...")
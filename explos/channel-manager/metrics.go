@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertybot"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry is the collector registry shared across the bot; it is
+// nil unless --metrics-listen is set, and while it is nil instrumentCommand
+// is a no-op passthrough.
+var metricsRegistry *prometheus.Registry
+
+var (
+	botCommandRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bot_command_requests_total",
+		Help: "Total number of bot command invocations, by command and outcome.",
+	}, []string{"command", "status"})
+
+	botCommandDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "bot_command_duration_seconds",
+		Help: "Time spent handling a bot command.",
+	}, []string{"command"})
+
+	botActiveWorkspaces = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bot_active_workspaces",
+		Help: "Number of workspaces currently tracked in the sqlite DB.",
+	})
+
+	botActiveChannels = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bot_active_channels",
+		Help: "Number of channels currently tracked in the sqlite DB.",
+	})
+
+	// botRefreshFailuresTotal is incremented by bertyBotRefresh and
+	// bertyBotRefreshAll whenever the Teritori API answers a refresh
+	// request with a non-2xx status.
+	botRefreshFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bot_refresh_failures_total",
+		Help: "Total number of failed channel refreshes against the Teritori API, by workspace.",
+	}, []string{"workspace"})
+)
+
+// setupMetrics builds the collector registry with the bot's collectors
+// registered on it; it returns nil when --metrics-listen is empty. Serving
+// the registry is left to serveMetrics.
+func setupMetrics(listen string) *prometheus.Registry {
+	if listen == "" {
+		return nil
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		botCommandRequestsTotal,
+		botCommandDurationSeconds,
+		botActiveWorkspaces,
+		botActiveChannels,
+		botRefreshFailuresTotal,
+	)
+	return registry
+}
+
+// serveMetrics runs the promhttp handler until ctx is cancelled; it is
+// meant to be registered as its own run.Group actor.
+func serveMetrics(ctx context.Context, listen string, registry *prometheus.Registry) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	server := &http.Server{Addr: listen, Handler: mux}
+	errC := make(chan error, 1)
+	go func() { errC <- server.ListenAndServe() }()
+
+	select {
+	case err := <-errC:
+		if err != nil && err != http.ErrServerClosed {
+			return fmt.Errorf("metrics server: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return server.Close()
+	}
+}
+
+// instrumentCommand wraps a command handler to record its request count and
+// duration. It is a passthrough when metrics are disabled.
+func instrumentCommand(name string, fn bertybot.CommandFunc) bertybot.CommandFunc {
+	if metricsRegistry == nil {
+		return fn
+	}
+
+	return func(ctx bertybot.Context) {
+		start := time.Now()
+		status := "ok"
+
+		defer func() {
+			if r := recover(); r != nil {
+				status = "panic"
+				botCommandDurationSeconds.WithLabelValues(name).Observe(time.Since(start).Seconds())
+				botCommandRequestsTotal.WithLabelValues(name, status).Inc()
+				panic(r)
+			}
+			botCommandDurationSeconds.WithLabelValues(name).Observe(time.Since(start).Seconds())
+			botCommandRequestsTotal.WithLabelValues(name, status).Inc()
+		}()
+
+		fn(ctx)
+	}
+}
+
+// recordRefreshFailure increments bot_refresh_failures_total for workspace;
+// called from bertyBotRefresh/bertyBotRefreshAll on non-2xx API responses.
+func recordRefreshFailure(workspace string) {
+	if metricsRegistry == nil {
+		return
+	}
+	botRefreshFailuresTotal.WithLabelValues(workspace).Inc()
+}
+
+// refreshActiveGauges recomputes bot_active_workspaces/bot_active_channels
+// from the sqlite DB; called periodically from doRoot and after the refresh
+// and refresh-all commands.
+func refreshActiveGauges(dbA *SqliteDB) {
+	if metricsRegistry == nil {
+		return
+	}
+	if n, err := dbA.CountWorkspaces(); err == nil {
+		botActiveWorkspaces.Set(float64(n))
+	}
+	if n, err := dbA.CountChannels(); err == nil {
+		botActiveChannels.Set(float64(n))
+	}
+}
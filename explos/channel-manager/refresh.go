@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"berty.tech/berty/v2/go/pkg/bertybot"
+
+	"github.com/pmg-tools/berty-bot-experiments/pkg/backoff"
+)
+
+// bertyBotRefresh refreshes the workspace named by the command's first
+// argument against the Teritori API.
+func bertyBotRefresh(dbA *SqliteDB, apiAdr string) bertybot.CommandFunc {
+	return func(ctx bertybot.Context) {
+		if ctx.IsReplay || !ctx.IsNew {
+			return
+		}
+
+		if len(ctx.Fields) == 0 {
+			_ = ctx.ReplyString("missing workspace name")
+			return
+		}
+		workspace := ctx.Fields[0]
+
+		if err := refreshWorkspace(context.Background(), apiAdr, workspace); err != nil {
+			_ = ctx.ReplyString(fmt.Sprintf("refresh failed: %v", err))
+			return
+		}
+
+		refreshActiveGauges(dbA)
+		_ = ctx.ReplyString("refreshed workspace " + workspace)
+	}
+}
+
+// bertyBotRefreshAll refreshes every workspace tracked in the DB against
+// the Teritori API.
+func bertyBotRefreshAll(dbA *SqliteDB, apiAdr string) bertybot.CommandFunc {
+	return func(ctx bertybot.Context) {
+		if ctx.IsReplay || !ctx.IsNew {
+			return
+		}
+
+		workspaces, err := dbA.ListWorkspaceNames()
+		if err != nil {
+			_ = ctx.ReplyString(fmt.Sprintf("refresh-all failed: %v", err))
+			return
+		}
+
+		var failed []string
+		for _, workspace := range workspaces {
+			if err := refreshWorkspace(context.Background(), apiAdr, workspace); err != nil {
+				failed = append(failed, workspace)
+			}
+		}
+
+		refreshActiveGauges(dbA)
+
+		if len(failed) > 0 {
+			_ = ctx.ReplyString(fmt.Sprintf("refreshed %d/%d workspaces, failed: %v", len(workspaces)-len(failed), len(workspaces), failed))
+			return
+		}
+		_ = ctx.ReplyString(fmt.Sprintf("refreshed %d workspaces", len(workspaces)))
+	}
+}
+
+// refreshWorkspace hits the Teritori API to refresh workspace, retrying
+// 5xx/network errors with backoff and treating 4xx as terminal. Non-2xx
+// responses are recorded against bot_refresh_failures_total{workspace}.
+func refreshWorkspace(ctx context.Context, apiAdr, workspace string) error {
+	err := backoff.Do(ctx, opts.retry, opts.rootLogger.Named("refresh"), "refresh workspace "+workspace, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiAdr+"/refresh/"+workspace, nil)
+		if err != nil {
+			return backoff.Permanent(fmt.Errorf("build refresh request: %w", err))
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("refresh request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			body, _ := ioutil.ReadAll(resp.Body)
+			recordRefreshFailure(workspace)
+			err := fmt.Errorf("refresh request: status %d: %s", resp.StatusCode, body)
+			if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+				return backoff.Permanent(err)
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
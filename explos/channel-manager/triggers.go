@@ -0,0 +1,181 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/bertybot"
+
+	"go.uber.org/zap"
+)
+
+// Trigger pairs a predicate with the handler to run when it matches. It is
+// the building block middlewares are written against: a middleware is just
+// a Trigger that either forwards to next or replies and stops the chain.
+type Trigger struct {
+	If   func(ctx bertybot.Context) bool
+	Then func(ctx bertybot.Context)
+}
+
+// Handle runs Then if If matches, and reports whether it did.
+func (t Trigger) Handle(ctx bertybot.Context) bool {
+	if !t.If(ctx) {
+		return false
+	}
+	t.Then(ctx)
+	return true
+}
+
+// Middleware wraps a command handler with cross-cutting behaviour (auth,
+// ownership, rate limiting, tracing, ...) that would otherwise need to be
+// copy-pasted into every bertyBotXxx closure.
+type Middleware func(next bertybot.CommandFunc) bertybot.CommandFunc
+
+// Chain composes middlewares around a handler, outermost first: Chain(a,
+// b)(handler) runs a, then b, then handler.
+func Chain(mw ...Middleware) func(bertybot.CommandFunc) bertybot.CommandFunc {
+	return func(final bertybot.CommandFunc) bertybot.CommandFunc {
+		for i := len(mw) - 1; i >= 0; i-- {
+			final = mw[i](final)
+		}
+		return final
+	}
+}
+
+// isLive reports whether ctx is a genuine, freshly-received command rather
+// than one of the events replayed on startup — the point at which it is
+// safe to reply and to count towards rate limits.
+func isLive(ctx bertybot.Context) bool {
+	return ctx.IsNew && !ctx.IsReplay
+}
+
+// requireLinkedTeritoriAccount rejects the command with a reminder to run
+// link-teritori-account unless the calling conversation already has a
+// bearer token on file.
+func requireLinkedTeritoriAccount(dbA *SqliteDB) Middleware {
+	return func(next bertybot.CommandFunc) bertybot.CommandFunc {
+		return func(ctx bertybot.Context) {
+			rejected := Trigger{
+				If: func(ctx bertybot.Context) bool {
+					_, _, _, err := dbA.GetTeritoriToken(ctx.Interaction.ConversationPublicKey)
+					return err != nil
+				},
+				Then: func(ctx bertybot.Context) {
+					if isLive(ctx) {
+						_ = ctx.ReplyString("this command requires a linked Teritori account, run link-teritori-account first")
+					}
+				},
+			}
+			if rejected.Handle(ctx) {
+				return
+			}
+			next(ctx)
+		}
+	}
+}
+
+// requireWorkspaceOwner rejects the command unless the calling conversation
+// owns the workspace named by its first argument.
+func requireWorkspaceOwner(dbA *SqliteDB) Middleware {
+	return func(next bertybot.CommandFunc) bertybot.CommandFunc {
+		return func(ctx bertybot.Context) {
+			missingName := Trigger{
+				If: func(ctx bertybot.Context) bool { return len(ctx.Fields) == 0 },
+				Then: func(ctx bertybot.Context) {
+					if isLive(ctx) {
+						_ = ctx.ReplyString("missing workspace name")
+					}
+				},
+			}
+			if missingName.Handle(ctx) {
+				return
+			}
+
+			workspace := ctx.Fields[0]
+			notOwner := Trigger{
+				If: func(ctx bertybot.Context) bool {
+					owner, err := dbA.IsWorkspaceOwner(ctx.Interaction.ConversationPublicKey, workspace)
+					return err != nil || !owner
+				},
+				Then: func(ctx bertybot.Context) {
+					if isLive(ctx) {
+						_ = ctx.ReplyString("you do not own workspace " + workspace)
+					}
+				},
+			}
+			if notOwner.Handle(ctx) {
+				return
+			}
+			next(ctx)
+		}
+	}
+}
+
+// rateLimit caps a conversation to perConv invocations within window, using
+// a simple fixed-window counter per conversation. The counter belongs to
+// the returned Middleware, so every command wrapped by that same Middleware
+// counts against one shared limit. It is intentionally in-process only: it
+// resets on restart and is not shared across bot replicas.
+//
+// Replayed/non-new events are passed straight to next without touching the
+// counter: the bot replays a conversation's full history on every startup,
+// and counting those would spuriously trip the limit on the first genuine
+// command after a restart.
+func rateLimit(perConv int, window time.Duration) Middleware {
+	type bucket struct {
+		count      int
+		windowFrom time.Time
+	}
+	var (
+		mu      sync.Mutex
+		buckets = map[string]*bucket{}
+	)
+
+	return func(next bertybot.CommandFunc) bertybot.CommandFunc {
+		return func(ctx bertybot.Context) {
+			if !isLive(ctx) {
+				next(ctx)
+				return
+			}
+
+			conversationID := ctx.Interaction.ConversationPublicKey
+
+			mu.Lock()
+			b, ok := buckets[conversationID]
+			now := time.Now()
+			if !ok || now.Sub(b.windowFrom) > window {
+				b = &bucket{count: 0, windowFrom: now}
+				buckets[conversationID] = b
+			}
+			b.count++
+			overLimit := b.count > perConv
+			mu.Unlock()
+
+			overLimitTrigger := Trigger{
+				If:   func(ctx bertybot.Context) bool { return overLimit },
+				Then: func(ctx bertybot.Context) { _ = ctx.ReplyString("rate limit exceeded, try again later") },
+			}
+			if overLimitTrigger.Handle(ctx) {
+				return
+			}
+			next(ctx)
+		}
+	}
+}
+
+// withTracing logs the start and completion (with duration) of every
+// command it wraps, so
+// command-level logs don't have to be added to each handler individually.
+func withTracing(logger *zap.Logger) Middleware {
+	return func(next bertybot.CommandFunc) bertybot.CommandFunc {
+		return func(ctx bertybot.Context) {
+			start := time.Now()
+			logger.Debug("command received",
+				zap.String("conversation", ctx.Interaction.ConversationPublicKey),
+				zap.Bool("is-new", ctx.IsNew),
+			)
+			next(ctx)
+			logger.Debug("command handled", zap.Duration("duration", time.Since(start)))
+		}
+	}
+}
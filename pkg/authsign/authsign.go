@@ -0,0 +1,94 @@
+// Package authsign signs Teritori authentication challenges with a locally
+// held keypair, and autodetects the on-disk key encoding so callers don't
+// need to care whether a key file is raw bytes or PEM-wrapped.
+package authsign
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// Alg identifies the signature scheme used to authenticate with the
+// Teritori API.
+type Alg string
+
+const (
+	AlgEd25519   Alg = "ed25519"
+	AlgSecp256k1 Alg = "secp256k1"
+)
+
+// ParseAlg validates a --sig-alg flag value.
+func ParseAlg(s string) (Alg, error) {
+	switch Alg(s) {
+	case AlgEd25519, AlgSecp256k1:
+		return Alg(s), nil
+	default:
+		return "", fmt.Errorf("unsupported signature algorithm %q (want %q or %q)", s, AlgEd25519, AlgSecp256k1)
+	}
+}
+
+// DecodeKeyBytes strips a PEM envelope around raw, if present, otherwise
+// returns raw unchanged. This lets key files be stored either as bare key
+// bytes or wrapped in a PEM block without the caller needing to know
+// which.
+//
+// This only supports this project's own convention of raw key bytes
+// wrapped in a generic PEM block (as produced by the bot's KeyStore) — it
+// does not parse standard PKCS#8/SEC1 DER. A key file exported from
+// another tool in proper PKCS#8 PEM form will decode to DER bytes here,
+// not a usable raw key; only import keys generated by this bot's
+// rotate-keys/KeyStore.
+func DecodeKeyBytes(raw []byte) []byte {
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return raw
+	}
+	return block.Bytes
+}
+
+// BuildChallenge concatenates the parts of a Teritori auth challenge in the
+// order the API expects them to be signed: nonce, then the Berty public
+// key, then the conversation the signature is bound to.
+func BuildChallenge(nonce, bertyPublicKey, conversationID string) []byte {
+	buf := make([]byte, 0, len(nonce)+len(bertyPublicKey)+len(conversationID))
+	buf = append(buf, nonce...)
+	buf = append(buf, bertyPublicKey...)
+	buf = append(buf, conversationID...)
+	return buf
+}
+
+// Sign signs msg with privateKey (as decoded by DecodeKeyBytes) using alg.
+//
+// Both algorithms sign a SHA-256 digest of msg rather than msg itself, so a
+// verifier can apply one challenge convention regardless of --sig-alg
+// instead of special-casing ed25519's ability to sign arbitrary-length
+// messages directly.
+func Sign(alg Alg, privateKey, msg []byte) ([]byte, error) {
+	digest := sha256.Sum256(msg)
+
+	switch alg {
+	case AlgEd25519:
+		if len(privateKey) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("ed25519 private key: want %d bytes, got %d", ed25519.PrivateKeySize, len(privateKey))
+		}
+		return ed25519.Sign(ed25519.PrivateKey(privateKey), digest[:]), nil
+
+	case AlgSecp256k1:
+		priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), privateKey)
+		if priv == nil {
+			return nil, fmt.Errorf("secp256k1 private key: invalid bytes")
+		}
+		sig, err := priv.Sign(digest[:])
+		if err != nil {
+			return nil, fmt.Errorf("secp256k1 sign: %w", err)
+		}
+		return sig.Serialize(), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported signature algorithm %q", alg)
+	}
+}
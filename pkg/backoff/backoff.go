@@ -0,0 +1,70 @@
+// Package backoff wraps github.com/cenkalti/backoff/v4 with the exponential
+// backoff + jitter policy this project uses for every outbound call to the
+// Teritori API or the Berty gRPC node, so a single flaky dependency never
+// silently drops a user request.
+package backoff
+
+import (
+	"context"
+	"time"
+
+	cenkalti "github.com/cenkalti/backoff/v4"
+	"go.uber.org/zap"
+)
+
+// Config holds the knobs exposed as --retry-* flags by callers.
+type Config struct {
+	MaxElapsedTime      time.Duration
+	InitialInterval     time.Duration
+	MaxInterval         time.Duration
+	Multiplier          float64
+	RandomizationFactor float64 // jitter, in [0, 1]
+}
+
+// DefaultConfig matches the connection-manager backoff policy used
+// elsewhere in the berty stack.
+var DefaultConfig = Config{
+	MaxElapsedTime:      2 * time.Minute,
+	InitialInterval:     500 * time.Millisecond,
+	MaxInterval:         30 * time.Second,
+	Multiplier:          1.5,
+	RandomizationFactor: 0.5,
+}
+
+func (c Config) newBackOff() cenkalti.BackOff {
+	eb := &cenkalti.ExponentialBackOff{
+		InitialInterval:     c.InitialInterval,
+		RandomizationFactor: c.RandomizationFactor,
+		Multiplier:          c.Multiplier,
+		MaxInterval:         c.MaxInterval,
+		MaxElapsedTime:      c.MaxElapsedTime,
+		Clock:               cenkalti.SystemClock,
+	}
+	eb.Reset()
+	return eb
+}
+
+// Permanent marks err as non-retryable, stopping Do immediately. Callers
+// should wrap terminal errors (e.g. HTTP 4xx) with this before returning
+// them from the retried function.
+func Permanent(err error) error {
+	return cenkalti.Permanent(err)
+}
+
+// Do retries fn according to cfg, logging each attempt's number and next
+// delay against label. It stops as soon as fn returns nil, a Permanent
+// error, or ctx is cancelled.
+func Do(ctx context.Context, cfg Config, logger *zap.Logger, label string, fn func() error) error {
+	attempt := 0
+	notify := func(err error, next time.Duration) {
+		attempt++
+		logger.Warn("retrying after error",
+			zap.String("operation", label),
+			zap.Int("attempt", attempt),
+			zap.Duration("next-delay", next),
+			zap.Error(err),
+		)
+	}
+
+	return cenkalti.RetryNotify(fn, cenkalti.WithContext(cfg.newBackOff(), ctx), notify)
+}